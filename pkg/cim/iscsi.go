@@ -3,6 +3,7 @@ package cim
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/microsoft/wmi/pkg/base/query"
 	cim "github.com/microsoft/wmi/pkg/wmiinstance"
@@ -50,13 +51,16 @@ func QueryISCSITargetPortal(address string, port uint32, selectorList []string)
 	return targetPortal, nil
 }
 
-// NewISCSITargetPortal creates a new iSCSI target portal.
+// NewISCSITargetPortal creates a new iSCSI target portal. If discoveryAuth is set,
+// the portal's discovery CHAP credentials are configured and a discovery cycle is
+// run against it immediately after creation.
 func NewISCSITargetPortal(targetPortalAddress string,
 	targetPortalPortNumber uint32,
 	initiatorInstanceName *string,
 	initiatorPortalAddress *string,
 	isHeaderDigest *bool,
-	isDataDigest *bool) (*storage.MSFT_iSCSITargetPortal, error) {
+	isDataDigest *bool,
+	discoveryAuth *DiscoveryAuth) (*storage.MSFT_iSCSITargetPortal, error) {
 	params := map[string]interface{}{
 		"TargetPortalAddress":    targetPortalAddress,
 		"TargetPortalPortNumber": targetPortalPortNumber,
@@ -78,7 +82,18 @@ func NewISCSITargetPortal(targetPortalAddress string,
 		return nil, fmt.Errorf("failed to create iSCSI target portal with %v. result: %d, error: %v", params, result, err)
 	}
 
-	return QueryISCSITargetPortal(targetPortalAddress, targetPortalPortNumber, nil)
+	portal, err := QueryISCSITargetPortal(targetPortalAddress, targetPortalPortNumber, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if discoveryAuth != nil {
+		if err := updateISCSITargetPortalDiscoveryCHAP(portal, discoveryAuth); err != nil {
+			return nil, err
+		}
+	}
+
+	return portal, nil
 }
 
 var (
@@ -247,13 +262,103 @@ func ListDisksByTarget(target *storage.MSFT_iSCSITarget, selectorList []string)
 	return filteredDisks, err
 }
 
-// ConnectISCSITarget establishes a connection to an iSCSI target with optional CHAP authentication credential.
-func ConnectISCSITarget(portalAddress string, portalPortNumber uint32, nodeAddress string, authType string, chapUsername *string, chapSecret *string) (int, map[string]interface{}, error) {
+// diskRescanInterval is the backoff interval WaitForDisksByTarget waits between
+// polling ListDisksByTarget and issuing a rescan.
+const diskRescanInterval = 2 * time.Second
+
+// WaitForDisksByTarget polls ListDisksByTarget for target, rescanning in between
+// polls, until every LUN in expectedLUNs is visible or timeout elapses. Without
+// this, callers race the SCSI bus rescan that happens after an iSCSI login and
+// have to sleep-and-retry ListDisksByTarget themselves.
+func WaitForDisksByTarget(target *storage.MSFT_iSCSITarget, expectedLUNs []uint32, timeout time.Duration) ([]*storage.MSFT_Disk, error) {
+	ticker := time.NewTicker(diskRescanInterval)
+	defer ticker.Stop()
+
+	timeoutChan := time.After(timeout)
+
+	for {
+		disks, err := ListDisksByTarget(target, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		ready, err := allLUNsVisible(disks, expectedLUNs)
+		if err != nil {
+			return nil, err
+		}
+		if ready {
+			return disks, nil
+		}
+
+		// disk.Update() only refreshes disks WMI already knows about, so it
+		// can never surface a LUN that hasn't been enumerated yet. Force a
+		// host-level bus rescan instead, unconditionally, on every tick.
+		if err := rescanHostStorageCache(); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-ticker.C:
+			continue
+		case <-timeoutChan:
+			return disks, fmt.Errorf("timed out waiting for %d LUNs to appear on iSCSI target, found %d disks", len(expectedLUNs), len(disks))
+		}
+	}
+}
+
+// rescanHostStorageCache forces the host to rescan its storage buses for new
+// disks, the WMI equivalent of "Rescan Disks" in Disk Management. It has to
+// be invoked unconditionally: unlike MSFT_Disk.Update, which only refreshes
+// a disk WMI already knows about, this is the only way for a LUN that just
+// appeared to be enumerated in the first place.
+func rescanHostStorageCache() error {
+	_, _, err := InvokeCimMethod(WMINamespaceStorage, "MSFT_StorageSetting", "UpdateHostStorageCache", nil)
+	if err != nil {
+		return fmt.Errorf("failed to rescan host storage cache. error: %v", err)
+	}
+
+	return nil
+}
+
+// allLUNsVisible reports whether every LUN in expectedLUNs has a matching disk.
+func allLUNsVisible(disks []*storage.MSFT_Disk, expectedLUNs []uint32) (bool, error) {
+	seenLUNs := make(map[uint32]bool, len(disks))
+	for _, disk := range disks {
+		lun, err := disk.GetPropertySCSILogicalUnit()
+		if err != nil {
+			return false, fmt.Errorf("failed to get SCSI logical unit of disk %v. error: %v", disk, err)
+		}
+
+		seenLUNs[uint32(lun)] = true
+	}
+
+	for _, lun := range expectedLUNs {
+		if !seenLUNs[lun] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// ConnectISCSITarget establishes a connection to an iSCSI target with optional one-way
+// CHAP authentication credential, and optional mutual CHAP (target authenticates to the
+// initiator) via mutualChapSecret. Mutual CHAP requires a one-time CHAP secret to be set
+// on the initiator ahead of the connect call. When persistent is true, the resulting
+// session is marked to automatically reconnect across reboots.
+func ConnectISCSITarget(portalAddress string, portalPortNumber uint32, nodeAddress string, authType string, chapUsername *string, chapSecret *string, mutualChapSecret *string, persistent bool) (int, map[string]interface{}, error) {
+	if mutualChapSecret != nil {
+		if err := SetISCSITargetMutualCHAPSecret(nodeAddress, *mutualChapSecret); err != nil {
+			return 0, nil, err
+		}
+	}
+
 	inParams := map[string]interface{}{
 		"NodeAddress":            nodeAddress,
 		"TargetPortalAddress":    portalAddress,
 		"TargetPortalPortNumber": int(portalPortNumber),
 		"AuthenticationType":     authType,
+		"IsPersistent":           persistent,
 	}
 	// InitiatorPortalAddress
 	// IsDataDigest
@@ -267,5 +372,277 @@ func ConnectISCSITarget(portalAddress string, portalPortNumber uint32, nodeAddre
 	}
 
 	result, outParams, err := InvokeCimMethod(WMINamespaceStorage, "MSFT_iSCSITarget", "Connect", inParams)
-	return result, outParams, err
+	if err != nil {
+		return result, outParams, err
+	}
+
+	if persistent {
+		if sessionID, ok := outParams["SessionIdentifier"].(string); ok && sessionID != "" {
+			if err := registerISCSISession(sessionID); err != nil {
+				return result, outParams, err
+			}
+		}
+	}
+
+	return result, outParams, nil
+}
+
+// registerISCSISession marks an already-connected iSCSI session, identified by its
+// SessionIdentifier, for automatic reconnect on startup by invoking
+// MSFT_iSCSISession.Register. Used to finish setting up a persistent session.
+func registerISCSISession(sessionIdentifier string) error {
+	sessionQuery := query.NewWmiQueryWithSelectList("MSFT_iSCSISession", nil, "SessionIdentifier", sessionIdentifier)
+	instances, err := QueryInstances(WMINamespaceStorage, sessionQuery)
+	if err != nil {
+		return fmt.Errorf("failed to find iSCSI session %s to register as persistent. error: %v", sessionIdentifier, err)
+	}
+
+	if _, err := instances[0].InvokeMethod("Register"); err != nil {
+		return fmt.Errorf("failed to register iSCSI session %s as persistent. error: %v", sessionIdentifier, err)
+	}
+
+	return nil
+}
+
+// SetISCSITargetMutualCHAPSecret sets the initiator's one-time CHAP secret that the
+// target uses to authenticate itself back to the initiator during mutual CHAP login.
+func SetISCSITargetMutualCHAPSecret(nodeAddress string, mutualChapSecret string) error {
+	inParams := map[string]interface{}{
+		"NodeAddress":      nodeAddress,
+		"TargetCHAPSecret": mutualChapSecret,
+	}
+
+	result, _, err := InvokeCimMethod(WMINamespaceStorage, "MSFT_iSCSITarget", "SetCHAPSecret", inParams)
+	if err != nil {
+		return fmt.Errorf("failed to set mutual CHAP secret for iSCSI target %s. result: %d, error: %v", nodeAddress, result, err)
+	}
+
+	return nil
+}
+
+// DiscoveryAuth carries the CHAP credentials used during the iSCSI discovery phase,
+// mirroring the chap_discovery settings the Linux iscsiadm-based plugins expose
+// separately from per-session (login) CHAP.
+type DiscoveryAuth struct {
+	// ChapUsername/ChapSecret authenticate the initiator to the portal during discovery.
+	ChapUsername string
+	ChapSecret   string
+
+	// MutualChapSecret, if set, authenticates the portal back to the initiator
+	// during discovery (bidirectional discovery CHAP).
+	MutualChapSecret string
+}
+
+// updateISCSITargetPortalDiscoveryCHAP configures discovery CHAP on portal and runs a
+// discovery cycle against it, so targets returned by the subsequent MSFT_iSCSITarget
+// enumeration reflect the newly discovered ones.
+func updateISCSITargetPortalDiscoveryCHAP(portal *storage.MSFT_iSCSITargetPortal, auth *DiscoveryAuth) error {
+	updateParams := map[string]interface{}{}
+	if auth.ChapUsername != "" {
+		updateParams["ChapUsername"] = auth.ChapUsername
+	}
+	if auth.ChapSecret != "" {
+		updateParams["ChapSecret"] = auth.ChapSecret
+	}
+	if auth.MutualChapSecret != "" {
+		updateParams["IsMutualCHAPEnabled"] = true
+		updateParams["MutualChapSecret"] = auth.MutualChapSecret
+	}
+
+	if len(updateParams) > 0 {
+		if _, err := portal.WmiInstance.InvokeMethod("Update", updateParams); err != nil {
+			return fmt.Errorf("failed to set discovery CHAP on iSCSI target portal %v. error: %v", portal, err)
+		}
+	}
+
+	if _, err := portal.WmiInstance.InvokeMethod("Discover"); err != nil {
+		return fmt.Errorf("failed to discover targets on iSCSI target portal %v. error: %v", portal, err)
+	}
+
+	return nil
+}
+
+// queryISCSITargetByNodeAddress retrieves the iSCSI target identified by nodeAddress,
+// regardless of which target portal it was discovered through.
+func queryISCSITargetByNodeAddress(nodeAddress string, selectorList []string) (*storage.MSFT_iSCSITarget, error) {
+	targetQuery := query.NewWmiQueryWithSelectList("MSFT_iSCSITarget", selectorList, "NodeAddress", nodeAddress)
+	instances, err := QueryInstances(WMINamespaceStorage, targetQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := storage.NewMSFT_iSCSITargetEx1(instances[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to query iSCSI target %s. error: %v", nodeAddress, err)
+	}
+
+	return target, nil
+}
+
+// ListISCSITargetPortalsByTarget retrieves every target portal linked to target via
+// the MSFT_iSCSITargetToiSCSITargetPortal association, so a multipath login can
+// log in across all of them instead of the single portal the caller knows about.
+func ListISCSITargetPortalsByTarget(target *storage.MSFT_iSCSITarget) ([]*storage.MSFT_iSCSITargetPortal, error) {
+	associated, err := target.GetAssociated("MSFT_iSCSITargetToiSCSITargetPortal", "MSFT_iSCSITargetPortal", "TargetPortal", "Target")
+	if err != nil {
+		return nil, err
+	}
+
+	var portals []*storage.MSFT_iSCSITargetPortal
+	for _, instance := range associated {
+		portal, err := storage.NewMSFT_iSCSITargetPortalEx1(instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query iSCSI target portal %v. error: %v", instance, err)
+		}
+
+		portals = append(portals, portal)
+	}
+
+	return portals, nil
+}
+
+// ListISCSISessionsByTarget lists every iSCSI session established against target,
+// across all of the target portals it may be reachable through.
+func ListISCSISessionsByTarget(target *storage.MSFT_iSCSITarget, selectorList []string) ([]*storage.MSFT_iSCSISession, error) {
+	sessionQuery := query.NewWmiQueryWithSelectList("MSFT_iSCSISession", selectorList)
+	sessionInstances, err := QueryInstances(WMINamespaceStorage, sessionQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	targetToTargetSessionMapping, err := ListISCSISessionToISCSITargetMapping()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered, err := FindInstancesByMapping(sessionInstances, iscsiSessionIndexer, []*cim.WmiInstance{target.WmiInstance}, iscsiTargetIndexer, targetToTargetSessionMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*storage.MSFT_iSCSISession
+	for _, instance := range filtered {
+		session, err := storage.NewMSFT_iSCSISessionEx1(instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query iSCSI session %v. error: %v", instance, err)
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// iscsiTargetMutex serializes attach/detach operations against the same iSCSI
+// target, keyed by NodeAddress. Concurrent MSFT_iSCSITarget.Connect invocations
+// for the same target from different gRPC handlers can otherwise create
+// duplicate sessions or return spurious "already connected" errors.
+var iscsiTargetMutex = NewKeyMutex()
+
+// ConnectISCSITargetMultipath logs in to every target portal discovered for
+// nodeAddress, instead of just the single portal the caller happens to pass in,
+// so multipathed targets end up with one session per portal the way the Linux
+// iscsiadm-based plugins already behave. It returns the SessionIdentifier of
+// every session its Connect calls created; sessions that already exist for
+// the target are not looked up or reused.
+func ConnectISCSITargetMultipath(nodeAddress string, authType string, chapUsername *string, chapSecret *string, mutualChapSecret *string, persistent bool) ([]string, error) {
+	iscsiTargetMutex.LockKey(nodeAddress)
+	defer iscsiTargetMutex.UnlockKey(nodeAddress)
+
+	target, err := queryISCSITargetByNodeAddress(nodeAddress, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find iSCSI target %s. error: %v", nodeAddress, err)
+	}
+
+	portals, err := ListISCSITargetPortalsByTarget(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list target portals for iSCSI target %s. error: %v", nodeAddress, err)
+	}
+	if len(portals) == 0 {
+		return nil, fmt.Errorf("no target portals found for iSCSI target %s", nodeAddress)
+	}
+
+	var sessionIDs []string
+	for _, portal := range portals {
+		portalAddress, err := portal.GetPropertyTargetPortalAddress()
+		if err != nil {
+			return sessionIDs, fmt.Errorf("failed to get target portal address for iSCSI target %s. error: %v", nodeAddress, err)
+		}
+
+		portalPortNumber, err := portal.GetPropertyTargetPortalPortNumber()
+		if err != nil {
+			return sessionIDs, fmt.Errorf("failed to get target portal port number for iSCSI target %s. error: %v", nodeAddress, err)
+		}
+
+		_, outParams, err := ConnectISCSITarget(portalAddress, uint32(portalPortNumber), nodeAddress, authType, chapUsername, chapSecret, mutualChapSecret, persistent)
+		if err != nil {
+			return sessionIDs, fmt.Errorf("failed to connect iSCSI target %s via portal %s:%d. error: %v", nodeAddress, portalAddress, portalPortNumber, err)
+		}
+
+		if sessionID, ok := outParams["SessionIdentifier"].(string); ok && sessionID != "" {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+
+	return sessionIDs, nil
+}
+
+// portalAddressForSession resolves the target portal address a session is
+// connected through. TargetPortalAddress is a property of MSFT_iSCSITargetPortal,
+// not MSFT_iSCSISession; session-level portal addressing lives one hop away, on
+// the MSFT_iSCSIConnection reached via the MSFT_iSCSISessionToiSCSIConnection
+// association.
+func portalAddressForSession(session *storage.MSFT_iSCSISession) (string, error) {
+	associated, err := session.GetAssociated("MSFT_iSCSISessionToiSCSIConnection", "MSFT_iSCSIConnection", "Connection", "Session")
+	if err != nil {
+		return "", err
+	}
+	if len(associated) == 0 {
+		return "", fmt.Errorf("no iSCSI connection found for session")
+	}
+
+	connection, err := storage.NewMSFT_iSCSIConnectionEx1(associated[0])
+	if err != nil {
+		return "", fmt.Errorf("failed to query iSCSI connection %v. error: %v", associated[0], err)
+	}
+
+	return connection.GetPropertyTargetAddress()
+}
+
+// DisconnectISCSITargetMultipath logs out of every session established
+// against nodeAddress. Sessions are keyed by (NodeAddress, TargetPortalAddress)
+// and belong exclusively to nodeAddress, so they are always disconnected here
+// regardless of whether other targets have sessions through the same target
+// portal IP: the MSFT_iSCSITargetPortal discovery registration itself is the
+// thing other targets could still share, and this function never removes
+// that, so there's nothing portal-level left to protect by skipping a
+// disconnect.
+func DisconnectISCSITargetMultipath(nodeAddress string) error {
+	iscsiTargetMutex.LockKey(nodeAddress)
+	defer iscsiTargetMutex.UnlockKey(nodeAddress)
+
+	target, err := queryISCSITargetByNodeAddress(nodeAddress, nil)
+	if err != nil {
+		return fmt.Errorf("failed to find iSCSI target %s. error: %v", nodeAddress, err)
+	}
+
+	sessions, err := ListISCSISessionsByTarget(target, []string{"SessionIdentifier"})
+	if err != nil {
+		return fmt.Errorf("failed to list iSCSI sessions for target %s. error: %v", nodeAddress, err)
+	}
+
+	var lastErr error
+	for _, session := range sessions {
+		portalAddress, err := portalAddressForSession(session)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to get target portal address for a session of iSCSI target %s. error: %v", nodeAddress, err)
+			continue
+		}
+
+		if _, err := session.WmiInstance.InvokeMethod("Disconnect"); err != nil {
+			lastErr = fmt.Errorf("failed to disconnect iSCSI session for target %s via portal %s. error: %v", nodeAddress, portalAddress, err)
+		}
+	}
+
+	return lastErr
 }
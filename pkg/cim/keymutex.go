@@ -0,0 +1,61 @@
+package cim
+
+import "sync"
+
+// KeyMutex is a set of mutexes keyed by an arbitrary string, used to serialize
+// operations against the same underlying resource (e.g. an iSCSI target's
+// NodeAddress, or an SMB share's remote path) without holding one lock across
+// unrelated keys. This mirrors the keymutex.KeyMutex Kubernetes' in-tree iSCSI
+// plugin uses to keep concurrent iscsiadm logins for the same target from
+// corrupting the initiator DB.
+//
+// Entries are reference-counted so a key with no current holders or waiters
+// is reclaimed instead of accumulating in the map forever.
+type KeyMutex struct {
+	mu      sync.Mutex
+	entries map[string]*keyMutexEntry
+}
+
+type keyMutexEntry struct {
+	mu       sync.Mutex
+	refCount int
+}
+
+// NewKeyMutex creates an empty KeyMutex.
+func NewKeyMutex() *KeyMutex {
+	return &KeyMutex{
+		entries: map[string]*keyMutexEntry{},
+	}
+}
+
+// LockKey blocks until the per-key lock for key is acquired.
+func (k *KeyMutex) LockKey(key string) {
+	k.mu.Lock()
+	entry, ok := k.entries[key]
+	if !ok {
+		entry = &keyMutexEntry{}
+		k.entries[key] = entry
+	}
+	entry.refCount++
+	k.mu.Unlock()
+
+	entry.mu.Lock()
+}
+
+// UnlockKey releases the per-key lock for key. The entry backing key is
+// reclaimed once no other caller holds or is waiting on it.
+func (k *KeyMutex) UnlockKey(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	entry, ok := k.entries[key]
+	if !ok {
+		return
+	}
+
+	entry.mu.Unlock()
+	entry.refCount--
+	if entry.refCount == 0 {
+		delete(k.entries, key)
+	}
+}
@@ -0,0 +1,224 @@
+package cim
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	ole "github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	wmi "github.com/microsoft/wmi/pkg/wmiinstance"
+)
+
+// wbemETimedout is the HRESULT SWbemEventSource.NextEvent returns when no
+// event arrives within the requested timeout. It is not itself an error
+// condition for InstanceWatcher.Next, just a cue to check ctx and poll again.
+const wbemETimedout uintptr = 0x80043001
+
+// wmiEventPollTimeoutMillis bounds how long a single NextEvent call blocks,
+// so Next can notice context cancellation in a timely manner.
+const wmiEventPollTimeoutMillis int32 = 1000
+
+// WMINamespaceCimV2 is the ROOT\CIMV2 namespace, home to Win32_Service and
+// most other core Windows management classes.
+const WMINamespaceCimV2 = "root\\cimv2"
+
+// ServiceStateChange describes one state transition observed by
+// WatchServiceState.
+type ServiceStateChange struct {
+	PreviousState string
+	CurrentState  string
+	ExitCode      uint32
+}
+
+// InstanceWatcher delivers successive instances from a WMI event
+// subscription started by WatchInstances.
+type InstanceWatcher interface {
+	// Next blocks until the next event instance arrives, or ctx is
+	// canceled.
+	Next(ctx context.Context) (*wmi.WmiInstance, error)
+
+	// Close tears down the underlying WMI event subscription.
+	Close() error
+}
+
+// WatchInstances subscribes to the WMI event query wql in namespace and
+// returns an InstanceWatcher delivering one instance per matching event.
+func WatchInstances(namespace string, wql string) (InstanceWatcher, error) {
+	return newWMIEventWatcher(namespace, wql)
+}
+
+// wmiEventWatcher is the InstanceWatcher backed by a synchronous WMI event
+// subscription (SWbemServices.ExecNotificationQuery /
+// SWbemEventSource.NextEvent), each subscription on its own session so that
+// multiple watchers can't block one another.
+type wmiEventWatcher struct {
+	sessionManager *wmi.WmiSessionManager
+	session        *wmi.WmiSession
+	events         *wmi.WmiSynchronousEventsList
+}
+
+// newWMIEventWatcher opens a dedicated local WMI session in namespace and
+// starts a synchronous event subscription for wql.
+func newWMIEventWatcher(namespace string, wql string) (InstanceWatcher, error) {
+	sessionManager := wmi.NewWmiSessionManager()
+
+	session, err := sessionManager.GetLocalSession(namespace)
+	if err != nil {
+		sessionManager.Dispose()
+		return nil, fmt.Errorf("failed to create WMI session for namespace %s: %w", namespace, err)
+	}
+
+	if _, err := session.Connect(); err != nil {
+		sessionManager.Dispose()
+		return nil, fmt.Errorf("failed to connect WMI session for namespace %s: %w", namespace, err)
+	}
+
+	events, err := session.ExecNotificationQuery(wql)
+	if err != nil {
+		session.Close()
+		sessionManager.Dispose()
+		return nil, fmt.Errorf("failed to subscribe to WMI event query %q: %w", wql, err)
+	}
+
+	return &wmiEventWatcher{
+		sessionManager: sessionManager,
+		session:        session,
+		events:         events,
+	}, nil
+}
+
+// Next implements InstanceWatcher.
+func (w *wmiEventWatcher) Next(ctx context.Context) (*wmi.WmiInstance, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		instance, err := w.events.WaitForNextEventUntil(wmiEventPollTimeoutMillis)
+		if err == nil {
+			return instance, nil
+		}
+		if !isWMIEventTimeout(err) {
+			return nil, fmt.Errorf("failed to wait for next WMI event: %w", err)
+		}
+	}
+}
+
+// Close implements InstanceWatcher.
+func (w *wmiEventWatcher) Close() error {
+	w.events.Close()
+	w.session.Close()
+	w.sessionManager.Dispose()
+	return nil
+}
+
+// isWMIEventTimeout reports whether err is the HRESULT NextEvent returns
+// when the poll window elapsed without an event, rather than a real failure.
+func isWMIEventTimeout(err error) bool {
+	oleErr, ok := err.(*ole.OleError)
+	return ok && oleErr.Code() == wbemETimedout
+}
+
+// WatchServiceState subscribes to WMI __InstanceModificationEvent
+// notifications for the Win32_Service instance named name, delivering one
+// ServiceStateChange per observed state transition on the returned channel.
+// The subscription is torn down and the channel closed when ctx is
+// canceled, or when the underlying watcher errors out.
+func WatchServiceState(ctx context.Context, name string) (<-chan ServiceStateChange, error) {
+	wql := fmt.Sprintf(
+		`SELECT * FROM __InstanceModificationEvent WITHIN 1 WHERE TargetInstance ISA "Win32_Service" AND TargetInstance.Name = "%s"`,
+		name,
+	)
+
+	watcher, err := WatchInstances(WMINamespaceCimV2, wql)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to state changes of service %s: %w", name, err)
+	}
+
+	changes := make(chan ServiceStateChange)
+
+	go func() {
+		defer close(changes)
+		defer watcher.Close()
+
+		for {
+			instance, err := watcher.Next(ctx)
+			if err != nil {
+				return
+			}
+
+			change, err := serviceStateChangeFromEvent(instance)
+			instance.Close()
+			if err != nil {
+				continue
+			}
+			// the event fires on any property change; only forward state changes
+			if change.PreviousState == change.CurrentState {
+				continue
+			}
+
+			select {
+			case changes <- change:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// serviceStateChangeFromEvent extracts the before/after Win32_Service state
+// from a raw __InstanceModificationEvent instance.
+func serviceStateChangeFromEvent(event *wmi.WmiInstance) (ServiceStateChange, error) {
+	target, err := embeddedEventInstance(event, "TargetInstance")
+	if err != nil {
+		return ServiceStateChange{}, fmt.Errorf("failed to get TargetInstance property of event: %w", err)
+	}
+	defer target.Close()
+
+	previous, err := embeddedEventInstance(event, "PreviousInstance")
+	if err != nil {
+		return ServiceStateChange{}, fmt.Errorf("failed to get PreviousInstance property of event: %w", err)
+	}
+	defer previous.Close()
+
+	currentState, err := target.GetProperty("State")
+	if err != nil {
+		return ServiceStateChange{}, fmt.Errorf("failed to get State property of TargetInstance: %w", err)
+	}
+	previousState, err := previous.GetProperty("State")
+	if err != nil {
+		return ServiceStateChange{}, fmt.Errorf("failed to get State property of PreviousInstance: %w", err)
+	}
+	exitCodeRaw, err := target.GetProperty("ExitCode")
+	if err != nil {
+		return ServiceStateChange{}, fmt.Errorf("failed to get ExitCode property of TargetInstance: %w", err)
+	}
+	exitCode, err := strconv.ParseUint(fmt.Sprintf("%v", exitCodeRaw), 10, 32)
+	if err != nil {
+		return ServiceStateChange{}, fmt.Errorf("failed to parse ExitCode property %v: %w", exitCodeRaw, err)
+	}
+
+	return ServiceStateChange{
+		PreviousState: fmt.Sprintf("%v", previousState),
+		CurrentState:  fmt.Sprintf("%v", currentState),
+		ExitCode:      uint32(exitCode),
+	}, nil
+}
+
+// embeddedEventInstance extracts the embedded-object property
+// propertyName (e.g. TargetInstance/PreviousInstance on a
+// __InstanceModificationEvent) as a *wmi.WmiInstance. WmiInstance.GetProperty
+// can't be used here: for embedded objects it unwraps the VARIANT to a raw
+// scalar/array value rather than preserving the IDispatch, so the property
+// has to be fetched directly off the event's IDispatch instead.
+func embeddedEventInstance(event *wmi.WmiInstance, propertyName string) (*wmi.WmiInstance, error) {
+	rawValue, err := oleutil.GetProperty(event.GetIDispatch(), propertyName)
+	if err != nil {
+		return nil, err
+	}
+
+	return wmi.CreateWmiInstance(rawValue, event.GetSession())
+}
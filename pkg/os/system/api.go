@@ -1,13 +1,17 @@
 package system
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/kubernetes-csi/csi-proxy/pkg/cim"
 	"github.com/kubernetes-csi/csi-proxy/pkg/server/system/impl"
 	wmierrors "github.com/microsoft/wmi/pkg/errors"
 	"github.com/microsoft/wmi/server2019/root/cimv2"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/mgr"
 )
 
 // Implements the System OS API calls. All code here should be very simple
@@ -71,6 +75,16 @@ var (
 
 	serviceStateCheckInternal = 500 * time.Millisecond
 	serviceStateCheckTimeout  = 30 * time.Second
+
+	// maxConcurrentServiceOps bounds how many services StartServices and
+	// StopServices operate on at once, so that a large batch doesn't flood
+	// WMI with concurrent requests.
+	maxConcurrentServiceOps = 8
+
+	// serviceGroupRegistryKeyPath is the registry key under HKLM holding one
+	// subkey per service group tag, each with a "Members" REG_MULTI_SZ value
+	// listing the names of its member services.
+	serviceGroupRegistryKeyPath = `SOFTWARE\CSIProxy\ServiceGroups`
 )
 
 func serviceStartModeToStartType(startMode string) uint32 {
@@ -94,10 +108,73 @@ type ServiceInterface interface {
 type ServiceManager interface {
 	WaitUntilServiceState(stateTransition stateTransitionFunc, stateCheck stateCheckFunc, interval time.Duration, timeout time.Duration) (string, error)
 	GetDependentsForService(name string) ([]string, error)
+	WatchService(ctx context.Context, name string) (<-chan ServiceStateEvent, error)
+}
+
+// ServiceStateEvent describes one state transition of a Windows service, as
+// delivered by ServiceManager.WatchService.
+type ServiceStateEvent struct {
+	Timestamp     time.Time
+	PreviousState string
+	CurrentState  string
+	ExitCode      uint32
 }
 
 type ServiceFactory interface {
 	GetService(name string) (ServiceInterface, error)
+	InstallService(name string, cfg ServiceConfig) error
+	UninstallService(name string) error
+	ReconfigureService(name string, cfg ServiceConfig) error
+}
+
+// ServiceConfig describes the configuration of a Windows service, as accepted
+// by InstallService and ReconfigureService.
+type ServiceConfig struct {
+	// DisplayName is the name shown for the service in the Windows Services
+	// management console.
+	DisplayName string
+
+	// BinPath is the fully qualified path to the service's binary, including
+	// any arguments.
+	BinPath string
+
+	// StartType is one of the impl.START_TYPE_* constants.
+	StartType uint32
+
+	// ErrorControl is one of the impl.SERVICE_ERROR_* constants, controlling
+	// what the Service Control Manager does if the service fails to start.
+	ErrorControl uint32
+
+	// Dependencies lists the names of services that must be started before
+	// this one.
+	Dependencies []string
+
+	// RecoveryActions, when non-empty, configures what the Service Control
+	// Manager does each time the service fails, e.g. restarting it.
+	RecoveryActions []mgr.RecoveryAction
+
+	// RecoveryResetPeriod is the number of seconds after which the failure
+	// count used to pick a RecoveryActions entry is reset to 0.
+	RecoveryResetPeriod uint32
+}
+
+// HostAPI is the set of OS-backed system calls the system API group depends
+// on. Depending on this interface, rather than the concrete APIImplementor,
+// lets the API group be constructed with a fake in unit tests without
+// spinning up WMI.
+type HostAPI interface {
+	GetBIOSSerialNumber() (string, error)
+	GetService(name string) (*ServiceInfo, error)
+	StartService(name string) error
+	StopService(name string, force bool) error
+	StartServices(names []string) (map[string]error, error)
+	StopServices(names []string, force bool) (map[string]error, error)
+	StartServiceGroup(groupTag string) (map[string]error, error)
+	StopServiceGroup(groupTag string, force bool) (map[string]error, error)
+	AddServiceToGroup(groupTag, name string) error
+	InstallService(name, binPath, displayName string, startType uint32, dependencies []string) error
+	UninstallService(name string) error
+	ReconfigureService(name string, cfg ServiceConfig) error
 }
 
 type APIImplementor struct {
@@ -105,7 +182,9 @@ type APIImplementor struct {
 	serviceManager ServiceManager
 }
 
-func New() APIImplementor {
+var _ HostAPI = APIImplementor{}
+
+func New() HostAPI {
 	serviceFactory := Win32ServiceFactory{}
 	return APIImplementor{
 		serviceFactory: serviceFactory,
@@ -179,7 +258,7 @@ func (impl APIImplementor) StartService(name string) error {
 		return state == serviceStateRunning, state, service, err
 	}
 
-	state, err := impl.serviceManager.WaitUntilServiceState(startService, serviceRunningCheck, serviceStateCheckInternal, serviceStateCheckTimeout)
+	state, err := impl.waitUntilServiceState(name, startService, serviceRunningCheck, serviceStateRunning)
 	if err != nil && !wmierrors.IsTimedout(err) {
 		return err
 	}
@@ -191,6 +270,47 @@ func (impl APIImplementor) StartService(name string) error {
 	return nil
 }
 
+// waitUntilServiceState performs stateTransition and then waits for name to
+// reach wantState. It prefers subscribing to serviceManager.WatchService for
+// an event-driven wait, falling back to serviceManager.WaitUntilServiceState's
+// polling loop if the subscription can't be established.
+func (impl APIImplementor) waitUntilServiceState(name string, stateTransition stateTransitionFunc, stateCheck stateCheckFunc, wantState string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), serviceStateCheckTimeout)
+	defer cancel()
+
+	events, err := impl.serviceManager.WatchService(ctx, name)
+	if err != nil {
+		return impl.serviceManager.WaitUntilServiceState(stateTransition, stateCheck, serviceStateCheckInternal, serviceStateCheckTimeout)
+	}
+
+	done, state, service, err := stateCheck()
+	if err != nil {
+		return state, err
+	}
+	if done {
+		return state, nil
+	}
+
+	if err := stateTransition(service); err != nil {
+		return state, err
+	}
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return state, wmierrors.Timedout
+			}
+			state = event.CurrentState
+			if state == wantState {
+				return state, nil
+			}
+		case <-ctx.Done():
+			return state, wmierrors.Timedout
+		}
+	}
+}
+
 func (impl APIImplementor) stopSingleService(name string) (bool, error) {
 	var dependentRunning bool
 	stopService := func(service ServiceInterface) error {
@@ -218,7 +338,7 @@ func (impl APIImplementor) stopSingleService(name string) (bool, error) {
 		return state == serviceStateStopped, state, service, err
 	}
 
-	state, err := impl.serviceManager.WaitUntilServiceState(stopService, serviceStoppedCheck, serviceStateCheckInternal, serviceStateCheckTimeout)
+	state, err := impl.waitUntilServiceState(name, stopService, serviceStoppedCheck, serviceStateStopped)
 	if err != nil && !wmierrors.IsTimedout(err) {
 		return dependentRunning, fmt.Errorf("error stopping service name %s. current state: %s", name, state)
 	}
@@ -251,6 +371,141 @@ func (impl APIImplementor) StopService(name string, force bool) error {
 	return nil
 }
 
+// runOnServices invokes fn for each name concurrently, bounded by
+// maxConcurrentServiceOps in-flight calls, and collects the error (if any)
+// returned for each one.
+func runOnServices(names []string, fn func(name string) error) map[string]error {
+	results := make(map[string]error, len(names))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentServiceOps)
+
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := fn(name)
+
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}(name)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// StartServices starts every named service concurrently and returns the
+// per-service result, keyed by name.
+func (sys APIImplementor) StartServices(names []string) (map[string]error, error) {
+	return runOnServices(names, sys.StartService), nil
+}
+
+// StopServices stops every named service concurrently and returns the
+// per-service result, keyed by name. force is applied independently to each
+// service, the same way it is for a single StopService call.
+func (sys APIImplementor) StopServices(names []string, force bool) (map[string]error, error) {
+	return runOnServices(names, func(name string) error {
+		return sys.StopService(name, force)
+	}), nil
+}
+
+// resolveServiceGroup returns the names of the services registered as
+// members of groupTag, read from serviceGroupRegistryKeyPath\<groupTag>.
+func resolveServiceGroup(groupTag string) ([]string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, serviceGroupRegistryKeyPath+`\`+groupTag, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open service group %s: %w", groupTag, err)
+	}
+	defer k.Close()
+
+	members, _, err := k.GetStringsValue("Members")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read members of service group %s: %w", groupTag, err)
+	}
+
+	return members, nil
+}
+
+// AddServiceToGroup registers name as a member of groupTag, creating the
+// group's registry key under serviceGroupRegistryKeyPath if name is its first
+// member. This is the only way a service group gets populated: without it,
+// StartServiceGroup/StopServiceGroup have no members to act on.
+func (sys APIImplementor) AddServiceToGroup(groupTag, name string) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, serviceGroupRegistryKeyPath+`\`+groupTag, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to open or create service group %s: %w", groupTag, err)
+	}
+	defer k.Close()
+
+	members, _, err := k.GetStringsValue("Members")
+	if err != nil && err != registry.ErrNotExist {
+		return fmt.Errorf("failed to read members of service group %s: %w", groupTag, err)
+	}
+
+	for _, existing := range members {
+		if existing == name {
+			return nil
+		}
+	}
+
+	if err := k.SetStringsValue("Members", append(members, name)); err != nil {
+		return fmt.Errorf("failed to add %s to service group %s: %w", name, groupTag, err)
+	}
+
+	return nil
+}
+
+// StartServiceGroup starts every service registered as a member of groupTag.
+func (sys APIImplementor) StartServiceGroup(groupTag string) (map[string]error, error) {
+	names, err := resolveServiceGroup(groupTag)
+	if err != nil {
+		return nil, err
+	}
+
+	return sys.StartServices(names)
+}
+
+// StopServiceGroup stops every service registered as a member of groupTag.
+func (sys APIImplementor) StopServiceGroup(groupTag string, force bool) (map[string]error, error) {
+	names, err := resolveServiceGroup(groupTag)
+	if err != nil {
+		return nil, err
+	}
+
+	return sys.StopServices(names, force)
+}
+
+// InstallService registers a new Windows service named name, running binPath,
+// so that CSI driver sidecars can be installed as services instead of being
+// shelled out to directly.
+func (sys APIImplementor) InstallService(name, binPath, displayName string, startType uint32, dependencies []string) error {
+	return sys.serviceFactory.InstallService(name, ServiceConfig{
+		DisplayName:  displayName,
+		BinPath:      binPath,
+		StartType:    startType,
+		ErrorControl: impl.SERVICE_ERROR_NORMAL,
+		Dependencies: dependencies,
+	})
+}
+
+// UninstallService removes the Windows service named name.
+func (sys APIImplementor) UninstallService(name string) error {
+	return sys.serviceFactory.UninstallService(name)
+}
+
+// ReconfigureService updates the configuration of the already-installed
+// Windows service named name, e.g. to change its start type or to turn on
+// auto-restart on failure via cfg.RecoveryActions.
+func (sys APIImplementor) ReconfigureService(name string, cfg ServiceConfig) error {
+	return sys.serviceFactory.ReconfigureService(name, cfg)
+}
+
 type Win32Service struct {
 	*cimv2.Win32_Service
 }
@@ -287,6 +542,90 @@ func (impl Win32ServiceFactory) GetService(name string) (ServiceInterface, error
 	return &Win32Service{Win32_Service: service}, nil
 }
 
+func (impl Win32ServiceFactory) InstallService(name string, cfg ServiceConfig) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.CreateService(name, cfg.BinPath, mgr.Config{
+		DisplayName:  cfg.DisplayName,
+		StartType:    cfg.StartType,
+		ErrorControl: cfg.ErrorControl,
+		Dependencies: cfg.Dependencies,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create service %s: %w", name, err)
+	}
+	defer s.Close()
+
+	if len(cfg.RecoveryActions) > 0 {
+		if err := s.SetRecoveryActions(cfg.RecoveryActions, cfg.RecoveryResetPeriod); err != nil {
+			return fmt.Errorf("failed to set recovery actions for service %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (impl Win32ServiceFactory) UninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("failed to open service %s: %w", name, err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (impl Win32ServiceFactory) ReconfigureService(name string, cfg ServiceConfig) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("failed to open service %s: %w", name, err)
+	}
+	defer s.Close()
+
+	winConfig, err := s.Config()
+	if err != nil {
+		return fmt.Errorf("failed to read config of service %s: %w", name, err)
+	}
+
+	winConfig.DisplayName = cfg.DisplayName
+	winConfig.BinaryPathName = cfg.BinPath
+	winConfig.StartType = cfg.StartType
+	winConfig.ErrorControl = cfg.ErrorControl
+	winConfig.Dependencies = cfg.Dependencies
+
+	if err := s.UpdateConfig(winConfig); err != nil {
+		return fmt.Errorf("failed to update config of service %s: %w", name, err)
+	}
+
+	if len(cfg.RecoveryActions) > 0 {
+		if err := s.SetRecoveryActions(cfg.RecoveryActions, cfg.RecoveryResetPeriod); err != nil {
+			return fmt.Errorf("failed to set recovery actions for service %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
 type ServiceManagerImpl struct {
 	serviceFactory ServiceFactory
 }
@@ -327,6 +666,36 @@ func (impl ServiceManagerImpl) WaitUntilServiceState(stateTransition stateTransi
 	}
 }
 
+// WatchService subscribes to WMI state-change notifications for the
+// service named name, translating each cim.ServiceStateChange into a
+// timestamped ServiceStateEvent. The returned channel is closed when ctx is
+// canceled or the underlying subscription ends.
+func (impl ServiceManagerImpl) WatchService(ctx context.Context, name string) (<-chan ServiceStateEvent, error) {
+	changes, err := cim.WatchServiceState(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan ServiceStateEvent)
+	go func() {
+		defer close(events)
+		for change := range changes {
+			select {
+			case events <- ServiceStateEvent{
+				Timestamp:     time.Now(),
+				PreviousState: change.PreviousState,
+				CurrentState:  change.CurrentState,
+				ExitCode:      change.ExitCode,
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
 func (impl ServiceManagerImpl) GetDependentsForService(name string) ([]string, error) {
 	var serviceNames []string
 	var servicesToCheck []ServiceInterface
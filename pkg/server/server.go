@@ -1,20 +1,165 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/Microsoft/go-winio"
 	grpcprom "github.com/grpc-ecosystem/go-grpc-middleware/providers/prometheus"
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors"
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/recovery"
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/selector"
 	"github.com/kubernetes-csi/csi-proxy/client"
 	srvtypes "github.com/kubernetes-csi/csi-proxy/pkg/server/types"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
 )
 
+// tracerShutdownTimeout bounds how long Stop waits for buffered spans to flush
+// to the OTLP collector before giving up.
+const tracerShutdownTimeout = 5 * time.Second
+
+// healthCheckServiceName is exempted from the auth interceptor, so liveness
+// probes don't need credentials to ask whether csi-proxy is up.
+const healthCheckServiceName = "grpc.health.v1.Health"
+
+// AuthFunc validates an incoming RPC, e.g. by checking a shared token or the
+// SID of the process on the other end of the named pipe, and returns an error
+// if the caller isn't allowed to drive this csi-proxy instance. A nil AuthFunc
+// passed to NewServer disables authentication.
+type AuthFunc func(ctx context.Context) (context.Context, error)
+
+// ListenerFactory creates the listener a versioned API's gRPC server accepts
+// connections on. The default, winio.ListenPipe, listens on a real named pipe;
+// tests can substitute net.Pipe or bufconn to exercise the full gRPC stack
+// in-process without spinning up WMI or named pipes.
+type ListenerFactory func(pipePath string) (net.Listener, error)
+
+// defaultListenerFactory listens on a real Windows named pipe at pipePath.
+func defaultListenerFactory(pipePath string) (net.Listener, error) {
+	return winio.ListenPipe(pipePath, nil)
+}
+
+// rpcLogger is the klog logger the structured per-RPC logging interceptor logs
+// through.
+var rpcLogger = klog.Background()
+
+// interceptorLogger adapts a klog logger to the grpc-middleware Logger
+// interface used by the structured logging interceptor.
+func interceptorLogger(l klog.Logger) logging.Logger {
+	return logging.LoggerFunc(func(ctx context.Context, lvl logging.Level, msg string, fields ...any) {
+		l := l.WithValues(fields...)
+		switch lvl {
+		case logging.LevelDebug:
+			l.V(4).Info(msg)
+		case logging.LevelInfo, logging.LevelWarn:
+			l.Info(msg)
+		case logging.LevelError:
+			l.Error(nil, msg)
+		default:
+			l.Info(msg)
+		}
+	})
+}
+
+// logTraceID attaches the active span's trace ID to the per-RPC log line when
+// that span is sampled, so logs and traces for the same request can be
+// correlated. Unsampled RPCs are logged without a trace ID.
+func logTraceID(ctx context.Context) logging.Fields {
+	spanCtx := oteltrace.SpanContextFromContext(ctx)
+	if !spanCtx.IsSampled() {
+		return nil
+	}
+
+	return logging.Fields{"traceID", spanCtx.TraceID().String()}
+}
+
+// allButHealthZ exempts the gRPC health checking service from the auth
+// interceptor, so kubelet and other liveness probes don't need credentials.
+func allButHealthZ(_ context.Context, callMeta interceptors.CallMeta) bool {
+	return callMeta.Service != healthCheckServiceName
+}
+
+// TracingConfig configures the OpenTelemetry tracer spans emitted by the gRPC
+// server (and, via W3C TraceContext/Baggage propagation, the CSI sidecars and
+// WMI/PowerShell calls around it) are recorded against. Passing a nil
+// *TracingConfig to NewServer leaves the global TracerProvider as the noop
+// default, so tracing stays opt-in.
+type TracingConfig struct {
+	// Endpoint is the OTLP/gRPC collector address, e.g. "localhost:4317".
+	Endpoint string
+	// Insecure disables TLS when dialing Endpoint.
+	Insecure bool
+	// SamplerRatio is the fraction of root spans that get sampled; a span whose
+	// parent was already sampled is always sampled regardless of this ratio.
+	SamplerRatio float64
+	// ResourceAttributes are additional resource attributes attached to every
+	// span, e.g. the API group/version a particular gRPC server is serving.
+	ResourceAttributes map[string]string
+}
+
+// newTracerProvider builds and registers globally an OTLP/gRPC TracerProvider
+// for cfg, batching spans to Endpoint with a parent-based ratio sampler.
+func newTracerProvider(ctx context.Context, cfg *TracingConfig) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName("csi-proxy"),
+		semconv.HostName(hostname),
+	}
+	for k, v := range cfg.ResourceAttributes {
+		attrs = append(attrs, attribute.String(k, v))
+	}
+
+	res, err := resource.New(ctx, resource.WithAttributes(attrs...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OTel resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SamplerRatio))),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp, nil
+}
+
 // Server aggregates a number of API groups and versions,
 // and serves requests for all of them.
 type Server struct {
@@ -24,10 +169,20 @@ type Server struct {
 	grpcServers        []*grpc.Server
 	prometheusRegistry *prometheus.Registry
 	prometheusMetrics  *grpcprom.ServerMetrics
+	panicsTotal        prometheus.Counter
+	tracingConfig      *TracingConfig
+	tracerProvider     *sdktrace.TracerProvider
+	authFunc           AuthFunc
+	listenerFactory    ListenerFactory
 }
 
-// NewServer creates a new Server for the given API groups.
-func NewServer(reg *prometheus.Registry, apiGroups ...srvtypes.APIGroup) *Server {
+// NewServer creates a new Server for the given API groups. A nil tracingConfig
+// leaves tracing disabled (spans go to the noop TracerProvider). A nil authFunc
+// leaves every RPC open to any caller that can open the named pipe; health
+// checks are never subject to authFunc. A nil listenerFactory defaults to winio.ListenPipe; pass a
+// substitute (e.g. backed by net.Pipe or bufconn) to drive the gRPC stack
+// in-process in tests.
+func NewServer(reg *prometheus.Registry, tracingConfig *TracingConfig, authFunc AuthFunc, listenerFactory ListenerFactory, apiGroups ...srvtypes.APIGroup) *Server {
 	versionedAPIs := make([]*srvtypes.VersionedAPI, 0, len(apiGroups))
 	for _, apiGroup := range apiGroups {
 		versionedAPIs = append(versionedAPIs, apiGroup.VersionedAPIs()...)
@@ -40,12 +195,45 @@ func NewServer(reg *prometheus.Registry, apiGroups ...srvtypes.APIGroup) *Server
 	)
 	reg.MustRegister(srvMetrics)
 
+	panicsTotal := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "csi_proxy_grpc_panics_total",
+		Help: "Total number of panics recovered from gRPC handlers.",
+	})
+	reg.MustRegister(panicsTotal)
+
+	if listenerFactory == nil {
+		listenerFactory = defaultListenerFactory
+	}
+
 	return &Server{
 		versionedAPIs:      versionedAPIs,
 		mutex:              &sync.Mutex{},
 		prometheusRegistry: reg,
 		prometheusMetrics:  srvMetrics,
+		panicsTotal:        panicsTotal,
+		tracingConfig:      tracingConfig,
+		authFunc:           authFunc,
+		listenerFactory:    listenerFactory,
+	}
+}
+
+// authFn validates an incoming RPC via s.authFunc, the shape go-grpc-middleware's
+// auth interceptor expects. With no authFunc configured, every caller is let through.
+func (s *Server) authFn(ctx context.Context) (context.Context, error) {
+	if s.authFunc == nil {
+		return ctx, nil
 	}
+
+	return s.authFunc(ctx)
+}
+
+// grpcPanicRecoveryHandler converts a panic recovered from a gRPC handler into
+// a codes.Internal error instead of crashing the whole csi-proxy process, and
+// counts it so operators can alert on a misbehaving API group.
+func (s *Server) grpcPanicRecoveryHandler(p any) error {
+	s.panicsTotal.Inc()
+	klog.Errorf("recovered from panic in gRPC handler: %v", p)
+	return status.Errorf(codes.Internal, "internal error")
 }
 
 // Start starts one GRPC server per API version; it is a blocking call, that returns
@@ -81,26 +269,13 @@ func (s *Server) startListening() (chan *versionedAPIDone, []error) {
 		return nil, ListenErr
 	}
 
-	return s.createAndStartGRPCServers(listeners), nil
-}
+	doneChan, err := s.createAndStartGRPCServers(listeners)
+	if err != nil {
+		return nil, []error{err}
+	}
 
-//
-//func (s *Server) createOtelExporter(ctx context.Context) {
-//	exporter, err := otlptracegrpc.New(ctx,
-//		otlptracegrpc.WithInsecure(),
-//	)
-//	if err != nil {
-//		log.Fatalf("failed to create exporter: %v", err)
-//	}
-//
-//	tp := sdktrace.NewTracerProvider(
-//		sdktrace.WithSampler(sdktrace.AlwaysSample()),
-//		sdktrace.WithBatcher(exporter),
-//	)
-//	otel.SetTracerProvider(tp)
-//	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
-//	//defer func() { _ = exporter.Shutdown(context.Background()) }()
-//}
+	return doneChan, nil
+}
 
 // createListeners creates the named pipes.
 func (s *Server) createListeners() (listeners []net.Listener, errors []error) {
@@ -109,7 +284,7 @@ func (s *Server) createListeners() (listeners []net.Listener, errors []error) {
 	for i, versionedAPI := range s.versionedAPIs {
 		pipePath := client.PipePath(versionedAPI.Group, versionedAPI.Version)
 
-		listener, err := winio.ListenPipe(pipePath, nil)
+		listener, err := s.listenerFactory(pipePath)
 		if err == nil {
 			listeners[i] = listener
 		} else {
@@ -135,26 +310,39 @@ type versionedAPIDone struct {
 }
 
 // createAndStartGRPCServers creates the GRPC servers, but doesn't start them just yet.
-func (s *Server) createAndStartGRPCServers(listeners []net.Listener) chan *versionedAPIDone {
+func (s *Server) createAndStartGRPCServers(listeners []net.Listener) (chan *versionedAPIDone, error) {
 	doneChan := make(chan *versionedAPIDone, len(s.versionedAPIs))
 	s.grpcServers = make([]*grpc.Server, len(s.versionedAPIs))
 
-	//s.createOtelExporter(context.Background())
+	if s.tracingConfig != nil {
+		tp, err := newTracerProvider(context.Background(), s.tracingConfig)
+		if err != nil {
+			// best effort: the listeners were already opened by createListeners
+			// and won't be retried, so close them rather than leaking the pipes.
+			for _, listener := range listeners {
+				if listener != nil {
+					listener.Close()
+				}
+			}
+			return nil, errors.Wrap(err, "failed to set up tracing")
+		}
+		s.tracerProvider = tp
+	}
 
 	for i, versionedAPI := range s.versionedAPIs {
 		opts := []grpc.ServerOption{
 			grpc.StatsHandler(otelgrpc.NewServerHandler()),
 			grpc.ChainUnaryInterceptor(
-				s.prometheusMetrics.UnaryServerInterceptor(), //grpcprom.WithExemplarFromContext(exemplarFromContext)),
-				//	logging.UnaryServerInterceptor(interceptorLogger(rpcLogger), logging.WithFieldsFromContext(logTraceID)),
-				//	selector.UnaryServerInterceptor(auth.UnaryServerInterceptor(authFn), selector.MatchFunc(allButHealthZ)),
-				//	recovery.UnaryServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
+				s.prometheusMetrics.UnaryServerInterceptor(),
+				logging.UnaryServerInterceptor(interceptorLogger(rpcLogger), logging.WithFieldsFromContext(logTraceID)),
+				selector.UnaryServerInterceptor(auth.UnaryServerInterceptor(s.authFn), selector.MatchFunc(allButHealthZ)),
+				recovery.UnaryServerInterceptor(recovery.WithRecoveryHandler(s.grpcPanicRecoveryHandler)),
 			),
 			grpc.ChainStreamInterceptor(
-				s.prometheusMetrics.StreamServerInterceptor(), //grpcprom.WithExemplarFromContext(exemplarFromContext)),
-				//	logging.StreamServerInterceptor(interceptorLogger(rpcLogger), logging.WithFieldsFromContext(logTraceID)),
-				//	selector.StreamServerInterceptor(auth.StreamServerInterceptor(authFn), selector.MatchFunc(allButHealthZ)),
-				//	recovery.StreamServerInterceptor(recovery.WithRecoveryHandler(grpcPanicRecoveryHandler)),
+				s.prometheusMetrics.StreamServerInterceptor(),
+				logging.StreamServerInterceptor(interceptorLogger(rpcLogger), logging.WithFieldsFromContext(logTraceID)),
+				selector.StreamServerInterceptor(auth.StreamServerInterceptor(s.authFn), selector.MatchFunc(allButHealthZ)),
+				recovery.StreamServerInterceptor(recovery.WithRecoveryHandler(s.grpcPanicRecoveryHandler)),
 			),
 		}
 		grpcServer := grpc.NewServer(opts...)
@@ -174,7 +362,7 @@ func (s *Server) createAndStartGRPCServers(listeners []net.Listener) chan *versi
 		}()
 	}
 
-	return doneChan
+	return doneChan, nil
 }
 
 func (s *Server) waitForGRPCServersToStop(doneChan chan *versionedAPIDone) (errs []error) {
@@ -219,5 +407,14 @@ func (s *Server) Stop() error {
 		}
 	}
 
+	if s.tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+		defer cancel()
+
+		if err := s.tracerProvider.Shutdown(ctx); err != nil {
+			klog.Errorf("failed to flush and shut down tracer provider: %v", err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,18 @@
+package impl
+
+// ErrorControl values recognized by the Windows Service Control Manager,
+// controlling what happens if the service fails to start at boot.
+const (
+	// SERVICE_ERROR_IGNORE logs the error but continues the startup operation.
+	SERVICE_ERROR_IGNORE = 0x00000000
+
+	// SERVICE_ERROR_NORMAL logs the error, displays a message box, and continues the startup operation.
+	SERVICE_ERROR_NORMAL = 0x00000001
+
+	// SERVICE_ERROR_SEVERE logs the error and restarts the system with the last-known-good configuration.
+	SERVICE_ERROR_SEVERE = 0x00000002
+
+	// SERVICE_ERROR_CRITICAL logs the error and restarts the system with the last-known-good
+	// configuration; if that configuration is already in use, startup fails.
+	SERVICE_ERROR_CRITICAL = 0x00000003
+)
@@ -13,9 +13,95 @@ type HostAPI interface {
 	IsSMBMapped(remotePath string) (bool, error)
 	NewSMBLink(remotePath, localPath string) error
 	NewSMBGlobalMapping(remotePath, username, password string) error
+	NewSMBGlobalMappingWithOptions(remotePath, username, password string, opts SMBMappingOptions) error
 	RemoveSMBGlobalMapping(remotePath string) error
 }
 
+// UNCHardeningRule configures UNC hardening (MS15-011) for a UNC path
+// prefix, rejecting the mapping unless the server satisfies the declared
+// requirements. See https://support.microsoft.com/en-us/topic/ms15-011.
+type UNCHardeningRule struct {
+	// Path is the UNC path prefix the rule applies to, e.g. \\server\share.
+	Path string
+
+	// RequireMutualAuthentication rejects the server unless it can prove its
+	// identity, preventing man-in-the-middle redirection of the share.
+	RequireMutualAuthentication bool
+
+	// RequireIntegrity rejects the connection unless it is signed.
+	RequireIntegrity bool
+
+	// RequirePrivacy rejects the connection unless it is encrypted.
+	RequirePrivacy bool
+}
+
+// SMBCredentialSource selects where NewSMBGlobalMappingWithOptions gets the
+// credentials for a mapping that isn't using Kerberos or SSO.
+type SMBCredentialSource int
+
+const (
+	// SMBCredentialSourcePlaintext builds the mapping's PSCredential from the
+	// username and password passed to NewSMBGlobalMappingWithOptions.
+	SMBCredentialSourcePlaintext SMBCredentialSource = iota
+
+	// SMBCredentialSourceLSAStored omits an explicit credential, so
+	// New-SmbGlobalMapping falls back to whatever credentials are already
+	// stored in the LSA for the remote server (e.g. via cmdkey).
+	SMBCredentialSourceLSAStored
+
+	// SMBCredentialSourceGMSA authenticates as the group-managed service
+	// account named by SMBMappingOptions.GMSAName.
+	SMBCredentialSourceGMSA
+)
+
+// SMBMappingOptions controls how NewSMBGlobalMappingWithOptions maps a
+// remote SMB share.
+type SMBMappingOptions struct {
+	// RequirePrivacy requires the mapped session to be encrypted.
+	RequirePrivacy bool
+
+	// RequireIntegrity requires the mapped session to be signed.
+	RequireIntegrity bool
+
+	// UseKerberos maps the share without an explicit username/password,
+	// relying on the caller's existing Kerberos identity (e.g. a gMSA)
+	// instead of a PSCredential built from username and password. Takes
+	// precedence over CredentialSource.
+	UseKerberos bool
+
+	// UseCredentialsFromSSO maps the share using the caller's single
+	// sign-on credentials, via New-SmbGlobalMapping's -UseCredentialsFromSSO
+	// switch, instead of an explicit PSCredential. Takes precedence over
+	// both UseKerberos and CredentialSource.
+	UseCredentialsFromSSO bool
+
+	// CredentialSource selects where the mapping's credentials come from
+	// when neither UseCredentialsFromSSO nor UseKerberos is set. The zero
+	// value, SMBCredentialSourcePlaintext, uses the username and password
+	// passed to NewSMBGlobalMappingWithOptions.
+	CredentialSource SMBCredentialSource
+
+	// GMSAName is the group-managed service account to authenticate as when
+	// CredentialSource is SMBCredentialSourceGMSA.
+	GMSAName string
+
+	// UseWriteThrough requires writes to be acknowledged by the remote
+	// server before returning, via New-SmbGlobalMapping's -UseWriteThrough
+	// switch, trading write throughput for durability.
+	UseWriteThrough bool
+
+	// SaveCredentials persists the mapping's credentials, via
+	// New-SmbGlobalMapping's -SaveCredentials switch, so the mapping can be
+	// re-established after disconnection without the caller supplying
+	// username/password again.
+	SaveCredentials bool
+
+	// UNCHardeningRules, when non-empty, are applied before the mapping is
+	// created so the mount is refused if the server doesn't meet the
+	// declared authentication/encryption requirements.
+	UNCHardeningRules []UNCHardeningRule
+}
+
 type smbAPI struct{}
 
 var _ HostAPI = &smbAPI{}
@@ -61,16 +147,58 @@ func (smbAPI) NewSMBLink(remotePath, localPath string) error {
 	return nil
 }
 
-func (smbAPI) NewSMBGlobalMapping(remotePath, username, password string) error {
+// NewSMBGlobalMapping maps remotePath using the given username and password,
+// requiring the session to be encrypted. It is a thin wrapper around
+// NewSMBGlobalMappingWithOptions for callers that don't need to customize
+// encryption, signing or Kerberos/UNC-hardening behavior.
+func (api smbAPI) NewSMBGlobalMapping(remotePath, username, password string) error {
+	return api.NewSMBGlobalMappingWithOptions(remotePath, username, password, SMBMappingOptions{RequirePrivacy: true})
+}
+
+// NewSMBGlobalMappingWithOptions maps remotePath, applying any
+// opts.UNCHardeningRules first and then creating the mapping per opts.
+// opts.UseCredentialsFromSSO and opts.UseKerberos (checked in that order)
+// each bypass username/password entirely; otherwise opts.CredentialSource
+// picks how the mapping's PSCredential is built from username, password and
+// opts.GMSAName.
+func (smbAPI) NewSMBGlobalMappingWithOptions(remotePath, username, password string, opts SMBMappingOptions) error {
+	if err := applyUNCHardeningRules(opts.UNCHardeningRules); err != nil {
+		return fmt.Errorf("NewSMBGlobalMapping failed to apply UNC hardening rules for %s: %w", remotePath, err)
+	}
+
 	// use PowerShell Environment Variables to store user input string to prevent command line injection
 	// https://docs.microsoft.com/en-us/powershell/module/microsoft.powershell.core/about/about_environment_variables?view=powershell-5.1
-	cmdLine := fmt.Sprintf(`$PWord = ConvertTo-SecureString -String $Env:smbpassword -AsPlainText -Force` +
-		`;$Credential = New-Object -TypeName System.Management.Automation.PSCredential -ArgumentList $Env:smbuser, $PWord` +
-		`;New-SmbGlobalMapping -RemotePath $Env:smbremotepath -Credential $Credential -RequirePrivacy $true`)
+	envVars := []string{
+		fmt.Sprintf("smbremotepath=%s", remotePath),
+		fmt.Sprintf("smbrequireprivacy=%t", opts.RequirePrivacy),
+		fmt.Sprintf("smbrequireintegrity=%t", opts.RequireIntegrity),
+		fmt.Sprintf("smbusewritethrough=%t", opts.UseWriteThrough),
+		fmt.Sprintf("smbsavecredentials=%t", opts.SaveCredentials),
+	}
+
+	const mappingFlags = `-RequirePrivacy ([System.Convert]::ToBoolean($Env:smbrequireprivacy)) ` +
+		`-RequireIntegrity ([System.Convert]::ToBoolean($Env:smbrequireintegrity)) ` +
+		`-UseWriteThrough ([System.Convert]::ToBoolean($Env:smbusewritethrough)) ` +
+		`-SaveCredentials ([System.Convert]::ToBoolean($Env:smbsavecredentials))`
 
-	if output, err := utils.RunPowershellCmd(cmdLine, fmt.Sprintf("smbuser=%s", username),
-		fmt.Sprintf("smbpassword=%s", password),
-		fmt.Sprintf("smbremotepath=%s", remotePath)); err != nil {
+	var cmdLine string
+	switch {
+	case opts.UseCredentialsFromSSO:
+		cmdLine = `New-SmbGlobalMapping -RemotePath $Env:smbremotepath -UseCredentialsFromSSO ` + mappingFlags
+	case opts.UseKerberos, opts.CredentialSource == SMBCredentialSourceLSAStored:
+		cmdLine = `New-SmbGlobalMapping -RemotePath $Env:smbremotepath ` + mappingFlags
+	case opts.CredentialSource == SMBCredentialSourceGMSA:
+		cmdLine = `$Credential = New-Object -TypeName System.Management.Automation.PSCredential -ArgumentList $Env:smbuser, (New-Object System.Security.SecureString)` +
+			`;New-SmbGlobalMapping -RemotePath $Env:smbremotepath -Credential $Credential ` + mappingFlags
+		envVars = append(envVars, fmt.Sprintf("smbuser=%s", opts.GMSAName))
+	default:
+		cmdLine = `$PWord = ConvertTo-SecureString -String $Env:smbpassword -AsPlainText -Force` +
+			`;$Credential = New-Object -TypeName System.Management.Automation.PSCredential -ArgumentList $Env:smbuser, $PWord` +
+			`;New-SmbGlobalMapping -RemotePath $Env:smbremotepath -Credential $Credential ` + mappingFlags
+		envVars = append(envVars, fmt.Sprintf("smbuser=%s", username), fmt.Sprintf("smbpassword=%s", password))
+	}
+
+	if output, err := utils.RunPowershellCmd(cmdLine, envVars...); err != nil {
 		return fmt.Errorf("NewSMBGlobalMapping failed. output: %q, err: %v", string(output), err)
 	}
 	return nil
@@ -88,6 +216,38 @@ func (smbAPI) NewSMBGlobalMapping(remotePath, username, password string) error {
 	//return nil
 }
 
+// applyUNCHardeningRules writes each rule to the
+// NetworkProvider\HardenedPaths policy registry key, so the client refuses
+// to use the UNC path unless the server satisfies the declared requirements.
+func applyUNCHardeningRules(rules []UNCHardeningRule) error {
+	for _, rule := range rules {
+		cmdLine := `New-Item -Path $Env:smbhardeningkey -Force | Out-Null` +
+			`;New-ItemProperty -Path $Env:smbhardeningkey -Name $Env:smbhardeningpath -Value $Env:smbhardeningvalue -PropertyType String -Force | Out-Null`
+
+		value := fmt.Sprintf("RequireMutualAuthentication=%d, RequireIntegrity=%d, RequirePrivacy=%d",
+			boolToHardeningFlag(rule.RequireMutualAuthentication),
+			boolToHardeningFlag(rule.RequireIntegrity),
+			boolToHardeningFlag(rule.RequirePrivacy))
+
+		output, err := utils.RunPowershellCmd(cmdLine,
+			`smbhardeningkey=HKLM:\SOFTWARE\Policies\Microsoft\Windows\NetworkProvider\HardenedPaths`,
+			fmt.Sprintf("smbhardeningpath=%s", rule.Path),
+			fmt.Sprintf("smbhardeningvalue=%s", value))
+		if err != nil {
+			return fmt.Errorf("error applying UNC hardening rule for %s. output: %s, err: %v", rule.Path, string(output), err)
+		}
+	}
+
+	return nil
+}
+
+func boolToHardeningFlag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func (smbAPI) RemoveSMBGlobalMapping(remotePath string) error {
 	smbQuery := query.NewWmiQuery("MSFT_SmbGlobalMapping", "RemotePath", remotePathForQuery(remotePath))
 	instances, err := cim.QueryInstances(cim.WMINamespaceSmb, smbQuery)